@@ -0,0 +1,646 @@
+package kprobes
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"encoding/gob"
+	"path/filepath"
+	"sync"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+)
+
+// dKey identifies a dEntry by the (device, inode) pair the kernel reports
+// for it. Ino alone is not unique across filesystems, so it is always
+// paired with the device numbers.
+type dKey struct {
+	Ino      uint64
+	DevMajor uint32
+	DevMinor uint32
+}
+
+func (k dKey) zero() bool {
+	return k == dKey{}
+}
+
+// dEntry is a single cached directory entry. It mirrors just enough of the
+// on-disk state (name, parent, children) to reconstruct a full path and to
+// walk the subtree rooted at a monitored directory.
+type dEntry struct {
+	Name     string
+	Ino      uint64
+	DevMajor uint32
+	DevMinor uint32
+	Depth    uint32
+
+	// Mode, Size, Mtime and Hash are a best-effort snapshot of the entry's
+	// stat(2) data as last confirmed by a reconciliation pass (see
+	// reconcile.go). They are zero until the first reconciliation touches
+	// this entry.
+	Mode  uint32
+	Size  int64
+	Mtime int64
+	Hash  merkleHash
+
+	// ParentKey lets Path() and RelPath() walk up to an ancestor that has
+	// been evicted to the cold tier and needs to be paged back in.
+	ParentKey dKey
+
+	parent   *dEntry
+	Children map[string]*dEntry
+
+	// refs counts hot descendants (including an in-flight move) that hold a
+	// live pointer to this entry. While refs > 0 the entry is pinned and
+	// the LRU must not evict it, since evicting it would either dangle a
+	// descendant's parent pointer or force an immediate re-fetch.
+	refs int32
+
+	cache *dEntryCache
+}
+
+// Path reconstructs the absolute path of the entry by walking up to the
+// monitored root, paging ancestors back in from the cold tier if needed.
+func (d *dEntry) Path() string {
+	if d.cache == nil {
+		return d.pathLocked()
+	}
+	d.cache.mu.Lock()
+	defer d.cache.mu.Unlock()
+	return d.pathLocked()
+}
+
+// pathLocked is Path()'s body, for callers that already hold d.cache.mu.
+// d.cache.Get takes the same (non-reentrant) lock, so any ancestor lookup
+// here must go through getLocked instead.
+func (d *dEntry) pathLocked() string {
+	parent := d.parent
+	if parent == nil && d.cache != nil && !d.ParentKey.zero() {
+		parent = d.cache.getLocked(d.ParentKey)
+	}
+	if parent == nil {
+		return d.Name
+	}
+	return filepath.Join(parent.pathLocked(), d.Name)
+}
+
+// RelPath reconstructs d's path relative to the monitored root it descends
+// from (the ancestor at Depth 0), which is what IgnoreMatcher.Match expects.
+// Unlike Path, it never includes the absolute filesystem prefix the
+// monitored root was added at, so patterns anchor correctly against it.
+func (d *dEntry) RelPath() string {
+	if d.cache == nil {
+		return d.relPathLocked()
+	}
+	d.cache.mu.Lock()
+	defer d.cache.mu.Unlock()
+	return d.relPathLocked()
+}
+
+// relPathLocked is RelPath()'s body, for callers that already hold
+// d.cache.mu; see pathLocked for why ancestor lookups must go through
+// getLocked.
+func (d *dEntry) relPathLocked() string {
+	if d.Depth == 0 {
+		return ""
+	}
+	parent := d.parent
+	if parent == nil && d.cache != nil && !d.ParentKey.zero() {
+		parent = d.cache.getLocked(d.ParentKey)
+	}
+	if parent == nil {
+		return d.Name
+	}
+	if parentRel := parent.relPathLocked(); parentRel != "" {
+		return filepath.Join(parentRel, d.Name)
+	}
+	return d.Name
+}
+
+// GetChild returns the cached child entry with the given name, or nil if
+// name hasn't been observed (or the directory isn't being tracked). If the
+// child was paged in from the cold tier as a bare name/key stub, GetChild
+// resolves it through the cache so callers always see the fully populated,
+// promoted-to-hot entry.
+func (d *dEntry) GetChild(name string) *dEntry {
+	child, ok := d.Children[name]
+	if !ok {
+		return nil
+	}
+	if d.cache != nil {
+		if full := d.cache.Get(child.key()); full != nil {
+			return full
+		}
+	}
+	return child
+}
+
+// Release detaches the entry from its parent and drops its children,
+// allowing them to be garbage collected once nothing else references them.
+func (d *dEntry) Release() {
+	if d.parent != nil && d.parent.Children != nil {
+		delete(d.parent.Children, d.Name)
+	}
+	d.parent = nil
+	d.Children = nil
+}
+
+func (d *dEntry) key() dKey {
+	return dKey{Ino: d.Ino, DevMajor: d.DevMajor, DevMinor: d.DevMinor}
+}
+
+// cacheMetrics exposes dEntryCache internals through the libbeat monitoring
+// registry, primarily so operators can tell whether the hot tier is sized
+// correctly for the monitored tree.
+type cacheMetrics struct {
+	hotSize    *monitoring.Uint
+	coldSize   *monitoring.Uint
+	evictions  *monitoring.Uint
+	coldHits   *monitoring.Uint
+	coldMisses *monitoring.Uint
+}
+
+func newCacheMetrics(reg *monitoring.Registry) cacheMetrics {
+	if reg == nil {
+		// keep the counters in a private registry so nothing is published
+		reg = monitoring.NewRegistry()
+	}
+	return cacheMetrics{
+		hotSize:    monitoring.NewUint(reg, "dentry_cache.hot.size"),
+		coldSize:   monitoring.NewUint(reg, "dentry_cache.cold.size"),
+		evictions:  monitoring.NewUint(reg, "dentry_cache.evictions"),
+		coldHits:   monitoring.NewUint(reg, "dentry_cache.cold.hits"),
+		coldMisses: monitoring.NewUint(reg, "dentry_cache.cold.misses"),
+	}
+}
+
+// dEntryCache is the directory-entry tree used by eProcessor to turn kprobe
+// (ino, device) pairs into full paths without a syscall per event, and to
+// reconstruct parent/child relationships as MOVE and CREATE/DELETE events
+// arrive.
+//
+// It is a two-tier cache: a bounded in-memory LRU (hot) backed by a small
+// embedded KV store (cold), so recursive monitoring of large trees (a
+// build tree, /var, ...) doesn't grow memory without bound. Entries that
+// are still reachable from the hot tier - an ancestor of a hot entry, or
+// one side of an in-flight rename - are pinned and skipped by eviction.
+type dEntryCache struct {
+	mu sync.Mutex
+
+	maxHot   int
+	hot      *list.List // of *dEntry, most recently used at the front
+	hotIndex map[dKey]*list.Element
+
+	cold *bbolt.DB
+
+	// moves tracks entries mid-rename, keyed by the TID that issued the
+	// MOVE_FROM, until the matching MOVE_TO (or a MoveClear) arrives.
+	moves map[uint64]*dEntry
+
+	// coldCount mirrors the number of keys in the cold bucket. It's
+	// maintained incrementally (see spillCold/deleteCold) rather than read
+	// back from bbolt's Bucket.Stats(), which walks the whole bucket and
+	// would turn every eviction into an O(cold-size) scan.
+	coldCount uint64
+
+	metrics cacheMetrics
+}
+
+var dentryBucket = []byte("dentries")
+
+// newDirEntryCache builds a cache with a hot tier bounded at maxHot
+// entries. If coldStorePath is non-empty, evicted entries spill to a bbolt
+// database there, which also lets monitoring resume without a full re-walk
+// after a restart. reg may be nil, in which case metrics aren't published.
+func newDirEntryCache(maxHot int, coldStorePath string, reg *monitoring.Registry) (*dEntryCache, error) {
+	c := &dEntryCache{
+		maxHot:   maxHot,
+		hot:      list.New(),
+		hotIndex: make(map[dKey]*list.Element),
+		moves:    make(map[uint64]*dEntry),
+		metrics:  newCacheMetrics(reg),
+	}
+
+	if coldStorePath != "" {
+		db, err := bbolt.Open(coldStorePath, 0o600, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := db.Update(func(tx *bbolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(dentryBucket)
+			return err
+		}); err != nil {
+			db.Close()
+			return nil, err
+		}
+		c.cold = db
+	}
+
+	return c, nil
+}
+
+// Close releases the cold-tier database, if one was opened.
+func (c *dEntryCache) Close() error {
+	if c.cold == nil {
+		return nil
+	}
+	return c.cold.Close()
+}
+
+// Get returns the cached entry for k, promoting it (and paging it in from
+// the cold tier) if necessary, or nil if it isn't tracked anywhere.
+func (c *dEntryCache) Get(k dKey) *dEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.getLocked(k)
+}
+
+func (c *dEntryCache) getLocked(k dKey) *dEntry {
+	if elem, ok := c.hotIndex[k]; ok {
+		c.hot.MoveToFront(elem)
+		return elem.Value.(*dEntry)
+	}
+
+	entry := c.loadCold(k)
+	if entry == nil {
+		c.metrics.coldMisses.Inc()
+		return nil
+	}
+
+	c.metrics.coldHits.Inc()
+	c.promoteLocked(entry)
+	return entry
+}
+
+// Add registers entry in the cache and, if parent is non-nil, links it as
+// one of parent's children. The entry is inserted into the hot tier.
+func (c *dEntryCache) Add(entry, parent *dEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.cache = c
+
+	if parent != nil {
+		entry.parent = parent
+		entry.ParentKey = parent.key()
+		entry.Depth = parent.Depth + 1
+		if parent.Children == nil {
+			parent.Children = make(map[string]*dEntry)
+		}
+		parent.Children[entry.Name] = entry
+	}
+
+	c.promoteLocked(entry)
+}
+
+// promoteLocked inserts/moves entry to the front of the hot list, pins its
+// ancestor chain, and evicts from the back if we're now over budget.
+// c.mu must be held.
+func (c *dEntryCache) promoteLocked(entry *dEntry) {
+	k := entry.key()
+
+	if elem, ok := c.hotIndex[k]; ok {
+		c.hot.MoveToFront(elem)
+		return
+	}
+
+	elem := c.hot.PushFront(entry)
+	c.hotIndex[k] = elem
+	c.pinAncestorsLocked(entry)
+	c.metrics.hotSize.Set(uint64(c.hot.Len()))
+
+	c.evictLocked()
+}
+
+// evictLocked drops entries from the back of the hot list, spilling them
+// to the cold tier, until we're within budget or every remaining entry is
+// pinned.
+func (c *dEntryCache) evictLocked() {
+	if c.maxHot <= 0 {
+		return
+	}
+
+	for c.hot.Len() > c.maxHot {
+		elem := c.evictionCandidateLocked()
+		if elem == nil {
+			// everything left is pinned; exceed the budget rather than
+			// corrupt the tree.
+			return
+		}
+
+		entry := elem.Value.(*dEntry)
+		c.hot.Remove(elem)
+		delete(c.hotIndex, entry.key())
+		c.unpinAncestorsLocked(entry)
+
+		// Persist entry (and its child-name index) to the cold tier before
+		// detaching it, then drop both directions of the link: its
+		// parent's Children entry (else the parent keeps the whole subtree
+		// reachable and a later Get would promote a second, divergent
+		// dEntry for the same key) and its own Children map (the cold
+		// record already has what's needed to rehydrate it).
+		c.spillCold(entry)
+		entry.Release()
+
+		c.metrics.hotSize.Set(uint64(c.hot.Len()))
+		c.metrics.evictions.Inc()
+	}
+}
+
+func (c *dEntryCache) evictionCandidateLocked() *list.Element {
+	for elem := c.hot.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*dEntry)
+		if entry.refs == 0 {
+			return elem
+		}
+	}
+	return nil
+}
+
+// pinAncestorsLocked increments the refcount of every ancestor of entry,
+// since entry (now hot) holds a live pointer to each of them.
+func (c *dEntryCache) pinAncestorsLocked(entry *dEntry) {
+	for p := entry.parent; p != nil; p = p.parent {
+		p.refs++
+	}
+}
+
+func (c *dEntryCache) unpinAncestorsLocked(entry *dEntry) {
+	for p := entry.parent; p != nil; p = p.parent {
+		p.refs--
+	}
+}
+
+// Remove drops entry, and everything beneath it, from the cache entirely
+// (hot and cold).
+func (c *dEntryCache) Remove(entry *dEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(entry)
+}
+
+func (c *dEntryCache) removeLocked(entry *dEntry) {
+	for _, child := range entry.Children {
+		c.removeLocked(child)
+	}
+
+	k := entry.key()
+	if elem, ok := c.hotIndex[k]; ok {
+		c.hot.Remove(elem)
+		delete(c.hotIndex, k)
+		c.unpinAncestorsLocked(entry)
+		c.metrics.hotSize.Set(uint64(c.hot.Len()))
+	}
+	c.deleteCold(k)
+
+	entry.Release()
+}
+
+// MoveFrom records that entry is being renamed away by tid, pending the
+// matching MoveTo. The entry is pinned for the duration of the rename so
+// it can't be evicted out from under the in-flight move.
+func (c *dEntryCache) MoveFrom(tid uint64, entry *dEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.refs++
+	c.moves[tid] = entry
+}
+
+// MoveTo completes a pending rename for tid into newParent/newName. If a
+// matching MoveFrom was recorded, the cached entry is relinked in place and
+// moved is true. Otherwise the caller is expected to fall back to walking
+// the new path from scratch.
+func (c *dEntryCache) MoveTo(tid uint64, newParent *dEntry, newName string, emit func(path string) error) (bool, error) {
+	c.mu.Lock()
+	entry, ok := c.moves[tid]
+	if ok {
+		delete(c.moves, tid)
+	}
+	if !ok {
+		c.mu.Unlock()
+		return false, nil
+	}
+
+	if entry.parent != nil && entry.parent.Children != nil {
+		delete(entry.parent.Children, entry.Name)
+	}
+	c.unpinAncestorsLocked(entry)
+
+	entry.Name = newName
+	entry.parent = newParent
+	entry.ParentKey = newParent.key()
+	entry.Depth = newParent.Depth + 1
+	if newParent.Children == nil {
+		newParent.Children = make(map[string]*dEntry)
+	}
+	newParent.Children[newName] = entry
+
+	c.pinAncestorsLocked(entry)
+	path := entry.pathLocked()
+	entry.refs--
+	c.mu.Unlock()
+
+	return true, emit(path)
+}
+
+// DirSnapshot returns the fields reconciliation needs to decide whether a
+// directory needs to be walked, plus its known children as a name->key
+// index, without holding c.mu across the filesystem syscalls the caller is
+// about to make. entry may be nil, in which case a zero snapshot is
+// returned.
+func (c *dEntryCache) DirSnapshot(entry *dEntry) (hash merkleHash, mtime int64, children map[string]dKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry == nil {
+		return merkleHash{}, 0, nil
+	}
+
+	if len(entry.Children) > 0 {
+		children = make(map[string]dKey, len(entry.Children))
+		for name, child := range entry.Children {
+			children[name] = child.key()
+		}
+	}
+	return entry.Hash, entry.Mtime, children
+}
+
+// RefreshDir records the merkle hash and mtime a reconciliation pass just
+// computed for entry.
+func (c *dEntryCache) RefreshDir(entry *dEntry, mode uint32, mtime int64, hash merkleHash) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.Mode = mode
+	entry.Mtime = mtime
+	entry.Hash = hash
+}
+
+// RefreshLeaf records the stat/hash a reconciliation pass just computed for
+// a non-directory entry, reporting whether its content (size or mtime, as
+// opposed to other metadata) looks like it changed since the last time we
+// recorded it.
+func (c *dEntryCache) RefreshLeaf(entry *dEntry, mode uint32, size, mtime int64, hash merkleHash) (contentChanged bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	contentChanged = entry.Size != size || entry.Mtime != mtime
+	entry.Mode = mode
+	entry.Size = size
+	entry.Mtime = mtime
+	entry.Hash = hash
+	return contentChanged
+}
+
+// MoveClear abandons any MoveFrom pending for tid, e.g. because the
+// matching MOVE_TO landed outside any monitored directory.
+func (c *dEntryCache) MoveClear(tid uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.moves[tid]; ok {
+		entry.refs--
+		delete(c.moves, tid)
+	}
+}
+
+// --- cold tier ---
+
+// coldRecord is the on-disk form of a dEntry: just enough to reconstruct
+// the tree without holding every descendant in memory.
+type coldRecord struct {
+	Name      string
+	ParentKey dKey
+	Depth     uint32
+	Mode      uint32
+	Size      int64
+	Mtime     int64
+	Hash      merkleHash
+	ChildKeys map[string]dKey
+}
+
+func encodeDKey(k dKey) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[0:8], k.Ino)
+	binary.BigEndian.PutUint32(buf[8:12], k.DevMajor)
+	binary.BigEndian.PutUint32(buf[12:16], k.DevMinor)
+	return buf
+}
+
+func (c *dEntryCache) spillCold(entry *dEntry) {
+	if c.cold == nil {
+		return
+	}
+
+	rec := coldRecord{
+		Name:      entry.Name,
+		ParentKey: entry.ParentKey,
+		Depth:     entry.Depth,
+		Mode:      entry.Mode,
+		Size:      entry.Size,
+		Mtime:     entry.Mtime,
+		Hash:      entry.Hash,
+	}
+	if len(entry.Children) > 0 {
+		rec.ChildKeys = make(map[string]dKey, len(entry.Children))
+		for name, child := range entry.Children {
+			rec.ChildKeys[name] = child.key()
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&rec); err != nil {
+		return
+	}
+
+	k := entry.key()
+	encodedKey := encodeDKey(k)
+	var isNew bool
+	err := c.cold.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(dentryBucket)
+		isNew = b.Get(encodedKey) == nil
+		return b.Put(encodedKey, buf.Bytes())
+	})
+	if err != nil {
+		return
+	}
+	if isNew {
+		c.coldCount++
+	}
+	c.metrics.coldSize.Set(c.coldCount)
+}
+
+func (c *dEntryCache) loadCold(k dKey) *dEntry {
+	if c.cold == nil {
+		return nil
+	}
+
+	var raw []byte
+	_ = c.cold.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(dentryBucket).Get(encodeDKey(k))
+		if v != nil {
+			raw = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if raw == nil {
+		return nil
+	}
+
+	var rec coldRecord
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&rec); err != nil {
+		return nil
+	}
+
+	entry := &dEntry{
+		Name:      rec.Name,
+		Ino:       k.Ino,
+		DevMajor:  k.DevMajor,
+		DevMinor:  k.DevMinor,
+		Depth:     rec.Depth,
+		Mode:      rec.Mode,
+		Size:      rec.Size,
+		Mtime:     rec.Mtime,
+		Hash:      rec.Hash,
+		ParentKey: rec.ParentKey,
+		cache:     c,
+	}
+
+	// Children are rehydrated lazily: GetChild only needs a name, and any
+	// cold child still resolves through Get(childKey) on demand, so we only
+	// need to remember which names map to which keys.
+	if len(rec.ChildKeys) > 0 {
+		entry.Children = make(map[string]*dEntry, len(rec.ChildKeys))
+		for name, childKey := range rec.ChildKeys {
+			entry.Children[name] = &dEntry{
+				Name:      name,
+				Ino:       childKey.Ino,
+				DevMajor:  childKey.DevMajor,
+				DevMinor:  childKey.DevMinor,
+				ParentKey: k,
+				cache:     c,
+			}
+		}
+	}
+
+	return entry
+}
+
+func (c *dEntryCache) deleteCold(k dKey) {
+	if c.cold == nil {
+		return
+	}
+	encodedKey := encodeDKey(k)
+	var existed bool
+	err := c.cold.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(dentryBucket)
+		existed = b.Get(encodedKey) != nil
+		return b.Delete(encodedKey)
+	})
+	if err != nil {
+		return
+	}
+	if existed {
+		c.coldCount--
+	}
+	c.metrics.coldSize.Set(c.coldCount)
+}
@@ -0,0 +1,138 @@
+package kprobes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestEntry(name string, ino uint64) *dEntry {
+	return &dEntry{Name: name, Ino: ino, DevMajor: 1, DevMinor: 1}
+}
+
+func TestDEntryCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	// root plus two children fits exactly in a hot tier of 3; adding a
+	// fourth forces one eviction.
+	c, err := newDirEntryCache(3, "", nil)
+	require.NoError(t, err)
+
+	root := newTestEntry("root", 1)
+	c.Add(root, nil)
+	a := newTestEntry("a", 2)
+	c.Add(a, root)
+	b := newTestEntry("b", 3)
+	c.Add(b, root)
+
+	// Touch a so it's more recently used than b, then add a third child to
+	// force an eviction.
+	assert.NotNil(t, c.Get(a.key()))
+
+	cc := newTestEntry("c", 4)
+	c.Add(cc, root)
+
+	assert.Nil(t, c.hotIndex[b.key()], "b should have been evicted as the least recently used entry")
+	assert.NotNil(t, c.hotIndex[a.key()], "a was touched more recently than b and should still be hot")
+	assert.NotNil(t, c.hotIndex[cc.key()])
+}
+
+func TestDEntryCache_AncestorRefsTrackHotDescendants(t *testing.T) {
+	c, err := newDirEntryCache(10, "", nil)
+	require.NoError(t, err)
+
+	root := newTestEntry("root", 1)
+	c.Add(root, nil)
+	child := newTestEntry("child", 2)
+	c.Add(child, root)
+	grandchild := newTestEntry("grandchild", 3)
+	c.Add(grandchild, child)
+
+	// Every ancestor of a hot entry is pinned (refs > 0) for as long as
+	// that descendant stays hot, since evicting an ancestor out from under
+	// a hot descendant would dangle its parent pointer. root picks up one
+	// ref from each of its two hot descendants (child and grandchild).
+	assert.Equal(t, int32(2), root.refs)
+	assert.Equal(t, int32(1), child.refs)
+
+	c.Remove(grandchild)
+
+	// grandchild is gone, but child is still hot and still pins root.
+	assert.Equal(t, int32(1), root.refs)
+	assert.Equal(t, int32(0), child.refs)
+}
+
+func TestDEntryCache_EvictionSkipsPinnedEntries(t *testing.T) {
+	// root is the oldest (least recently used) entry once "other" is added,
+	// which would normally make it the eviction candidate - but it's pinned
+	// by its hot child, so child is evicted in its place instead.
+	c, err := newDirEntryCache(2, "", nil)
+	require.NoError(t, err)
+
+	root := newTestEntry("root", 1)
+	c.Add(root, nil)
+	child := newTestEntry("child", 2)
+	c.Add(child, root)
+
+	other := newTestEntry("other-root", 3)
+	c.Add(other, nil)
+
+	assert.NotNil(t, c.hotIndex[root.key()], "root is pinned by its hot child and must survive eviction")
+	assert.NotNil(t, c.hotIndex[other.key()])
+	assert.Nil(t, c.hotIndex[child.key()], "child, not the pinned root, should be the one evicted")
+}
+
+func TestDEntryCache_MoveFromMoveTo_RelinksEntry(t *testing.T) {
+	c, err := newDirEntryCache(0, "", nil)
+	require.NoError(t, err)
+
+	srcDir := newTestEntry("src", 1)
+	c.Add(srcDir, nil)
+	dstDir := newTestEntry("dst", 2)
+	c.Add(dstDir, nil)
+
+	entry := newTestEntry("file.txt", 3)
+	c.Add(entry, srcDir)
+
+	c.MoveFrom(42, entry)
+
+	var emittedPath string
+	moved, err := c.MoveTo(42, dstDir, "renamed.txt", func(path string) error {
+		emittedPath = path
+		return nil
+	})
+	require.NoError(t, err)
+	assert.True(t, moved)
+	assert.Equal(t, "dst/renamed.txt", emittedPath)
+	assert.Equal(t, entry, dstDir.GetChild("renamed.txt"))
+	assert.Nil(t, srcDir.GetChild("file.txt"))
+}
+
+func TestDEntryCache_MoveToWithoutMoveFromReturnsFalse(t *testing.T) {
+	c, err := newDirEntryCache(0, "", nil)
+	require.NoError(t, err)
+
+	dstDir := newTestEntry("dst", 1)
+	c.Add(dstDir, nil)
+
+	moved, err := c.MoveTo(99, dstDir, "whatever", func(string) error {
+		t.Fatal("emit should not be called when there's no pending MoveFrom")
+		return nil
+	})
+	require.NoError(t, err)
+	assert.False(t, moved)
+}
+
+func TestDEntryCache_RemoveDropsSubtree(t *testing.T) {
+	c, err := newDirEntryCache(0, "", nil)
+	require.NoError(t, err)
+
+	root := newTestEntry("root", 1)
+	c.Add(root, nil)
+	child := newTestEntry("child", 2)
+	c.Add(child, root)
+
+	c.Remove(child)
+
+	assert.Nil(t, c.Get(child.key()))
+	assert.Nil(t, root.GetChild("child"))
+}
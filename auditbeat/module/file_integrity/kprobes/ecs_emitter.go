@@ -0,0 +1,365 @@
+package kprobes
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+// Publisher is the minimal interface ECSEmitter needs to hand off a
+// finished event; it's satisfied by a beat.Client's Publish (wrapped to
+// take a bare mapstr.M) or anything else that wants to receive them.
+type Publisher interface {
+	Publish(event mapstr.M)
+}
+
+// ECSEmitter turns the raw (path, pid, op) triples eProcessor produces into
+// ECS-shaped events: file.*, process.* and event.* fields ready for the
+// auditbeat pipeline.
+//
+// Enrichment (stat'ing the path, resolving pid to a process, hashing small
+// files) is too expensive to do on the kprobe reader goroutine, so it
+// happens on a bounded worker pool instead. When that pool can't keep up,
+// ECSEmitter degrades: it publishes a minimal {path, pid, action} event and
+// bumps droppedEnrichment rather than block the reader.
+type ECSEmitter struct {
+	publish Publisher
+	jobs    chan ecsJob
+
+	hashSizeCap int64
+	procs       *procCache
+
+	wg sync.WaitGroup
+
+	droppedEnrichment *monitoring.Uint
+}
+
+type ecsJob struct {
+	path string
+	pid  uint32
+	op   uint32
+}
+
+// NewECSEmitter starts workers goroutines draining a queue of depth
+// queueSize. hashSizeCap bounds which files get a file.hash.sha256 computed
+// (0 disables hashing). procTTL bounds how long a resolved pid is trusted
+// before /proc is consulted again, since pids get recycled. reg may be nil.
+func NewECSEmitter(publish Publisher, workers, queueSize int, hashSizeCap int64, procTTL time.Duration, reg *monitoring.Registry) *ECSEmitter {
+	e := &ECSEmitter{
+		publish:           publish,
+		jobs:              make(chan ecsJob, queueSize),
+		hashSizeCap:       hashSizeCap,
+		procs:             newProcCache(procTTL),
+		droppedEnrichment: monitoring.NewUint(reg, "ecs_emitter.dropped_enrichment"),
+	}
+
+	e.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go e.worker()
+	}
+
+	return e
+}
+
+// Close stops accepting new events and waits for in-flight ones to drain.
+func (e *ECSEmitter) Close() {
+	close(e.jobs)
+	e.wg.Wait()
+}
+
+// Emit implements Emitter. It never blocks: on a full queue it publishes a
+// degraded event immediately instead of waiting for a worker slot.
+func (e *ECSEmitter) Emit(path string, pid uint32, op uint32) error {
+	select {
+	case e.jobs <- ecsJob{path: path, pid: pid, op: op}:
+	default:
+		e.droppedEnrichment.Inc()
+		e.publish.Publish(e.degradedEvent(path, pid, op))
+	}
+	return nil
+}
+
+func (e *ECSEmitter) worker() {
+	defer e.wg.Done()
+	for job := range e.jobs {
+		e.publish.Publish(e.enrich(job))
+	}
+}
+
+func (e *ECSEmitter) degradedEvent(path string, pid uint32, op uint32) mapstr.M {
+	action, _ := ecsAction(op)
+	return mapstr.M{
+		"file":    mapstr.M{"path": path},
+		"process": mapstr.M{"pid": pid},
+		"event":   mapstr.M{"action": action},
+	}
+}
+
+// enrich builds the full event for job: stat'ing the path (skipped for
+// IN_DELETE, where there's nothing left to stat), resolving the pid to a
+// process, and hashing the file if it's small enough.
+func (e *ECSEmitter) enrich(job ecsJob) mapstr.M {
+	action, eventType := ecsAction(job.op)
+
+	processFields := e.procs.lookup(job.pid).toECS()
+	processFields["pid"] = job.pid
+
+	event := mapstr.M{
+		"event": mapstr.M{
+			"action":   action,
+			"type":     eventType,
+			"category": []string{"file"},
+		},
+		"process": processFields,
+	}
+
+	fileFields := mapstr.M{"path": job.path}
+	if job.op != unix.IN_DELETE {
+		if fi, st, err := lstatFile(job.path); err == nil {
+			fileFields["size"] = fi.Size()
+			fileFields["mtime"] = fi.ModTime()
+			fileFields["mode"] = fmt.Sprintf("%#o", fi.Mode().Perm())
+			fileFields["inode"] = strconv.FormatUint(st.Ino, 10)
+			fileFields["owner"] = strconv.FormatUint(uint64(st.Uid), 10)
+			fileFields["group"] = strconv.FormatUint(uint64(st.Gid), 10)
+			fileFields["ctime"] = time.Unix(st.Ctim.Sec, st.Ctim.Nsec)
+
+			if fi.Mode().IsRegular() && e.hashSizeCap > 0 && fi.Size() <= e.hashSizeCap {
+				if sum, err := sha256File(job.path); err == nil {
+					fileFields["hash"] = mapstr.M{"sha256": sum}
+				}
+			}
+		}
+	}
+	event["file"] = fileFields
+
+	return event
+}
+
+// ecsAction maps a raw unix.IN_* op to an ECS event.action / event.type
+// pair.
+func ecsAction(op uint32) (action string, eventType []string) {
+	switch op {
+	case unix.IN_CREATE:
+		return "file_create", []string{"creation"}
+	case unix.IN_MODIFY:
+		return "file_modify", []string{"change"}
+	case unix.IN_ATTRIB:
+		return "file_attrib", []string{"change"}
+	case unix.IN_DELETE:
+		return "file_delete", []string{"deletion"}
+	case unix.IN_MOVED_FROM:
+		return "file_rename_from", []string{"change"}
+	case unix.IN_MOVED_TO:
+		return "file_rename_to", []string{"change"}
+	default:
+		return "file_unknown", []string{"info"}
+	}
+}
+
+func lstatFile(path string) (os.FileInfo, *unix.Stat_t, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	st, ok := fi.Sys().(*unix.Stat_t)
+	if !ok {
+		return nil, nil, os.ErrInvalid
+	}
+	return fi, st, nil
+}
+
+// sha256File hashes path's contents. Callers are expected to have already
+// checked the file is small enough to be worth it.
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// procInfo is the subset of /proc/<pid> ECS cares about.
+type procInfo struct {
+	name       string
+	executable string
+	args       []string
+	start      time.Time
+
+	cachedAt time.Time
+}
+
+func (p procInfo) toECS() mapstr.M {
+	return mapstr.M{
+		"name":       p.name,
+		"executable": p.executable,
+		"args":       p.args,
+		"start":      p.start,
+	}
+}
+
+// procCache resolves pids to procInfo, with a TTL since pids are recycled
+// by the kernel and a stale cache entry would attribute an event to the
+// wrong process.
+type procCache struct {
+	mu      sync.Mutex
+	entries map[uint32]procInfo
+	ttl     time.Duration
+}
+
+func newProcCache(ttl time.Duration) *procCache {
+	return &procCache{
+		entries: make(map[uint32]procInfo),
+		ttl:     ttl,
+	}
+}
+
+func (c *procCache) lookup(pid uint32) procInfo {
+	c.mu.Lock()
+	if info, ok := c.entries[pid]; ok && time.Since(info.cachedAt) < c.ttl {
+		c.mu.Unlock()
+		return info
+	}
+	c.mu.Unlock()
+
+	info := readProc(pid)
+	info.cachedAt = time.Now()
+
+	c.mu.Lock()
+	c.entries[pid] = info
+	c.mu.Unlock()
+
+	return info
+}
+
+// readProc is best-effort: a pid that has already exited (common, since
+// short-lived processes are exactly the ones worth auditing) just yields a
+// mostly-empty procInfo rather than an error.
+func readProc(pid uint32) procInfo {
+	base := fmt.Sprintf("/proc/%d", pid)
+	var info procInfo
+
+	if exe, err := os.Readlink(base + "/exe"); err == nil {
+		info.executable = exe
+	}
+
+	if comm, err := os.ReadFile(base + "/comm"); err == nil {
+		info.name = strings.TrimSpace(string(comm))
+	}
+
+	if cmdline, err := os.ReadFile(base + "/cmdline"); err == nil {
+		for _, arg := range strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00") {
+			if arg != "" {
+				info.args = append(info.args, arg)
+			}
+		}
+	}
+
+	if fi, err := os.Stat(base); err == nil {
+		info.start = fi.ModTime()
+	}
+	if start, err := readProcStartTime(base); err == nil {
+		info.start = start
+	}
+
+	return info
+}
+
+// readProcStartTime reads the process start time (field 22) out of
+// /proc/<pid>/stat, which is more precise than the directory's mtime.
+func readProcStartTime(base string) (time.Time, error) {
+	f, err := os.Open(base + "/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return time.Time{}, os.ErrInvalid
+	}
+
+	// The second field is "(comm)" and may itself contain spaces/parens, so
+	// split on the last ')' before falling back to simple whitespace
+	// splitting of the remaining fields.
+	line := scanner.Text()
+	idx := strings.LastIndex(line, ")")
+	if idx < 0 {
+		return time.Time{}, os.ErrInvalid
+	}
+	fields := strings.Fields(line[idx+1:])
+	const startTimeField = 22 - 3 // field 3 (state) is fields[0]; pid+comm already consumed
+	if len(fields) <= startTimeField {
+		return time.Time{}, os.ErrInvalid
+	}
+
+	ticks, err := strconv.ParseInt(fields[startTimeField], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return bootTimeToWall(ticks)
+}
+
+// clockTicksPerSec is USER_HZ, the unit /proc/<pid>/stat's start time field
+// is expressed in. It is 100 on effectively every Linux configuration that
+// matters here, so we hard-code it rather than shell out to getconf.
+const clockTicksPerSec = 100
+
+var (
+	bootTimeOnce sync.Once
+	bootTime     time.Time
+	bootTimeErr  error
+)
+
+// bootTimeToWall converts a /proc/<pid>/stat start-time tick count into a
+// wall-clock time by adding it to the system boot time from /proc/stat.
+func bootTimeToWall(ticks int64) (time.Time, error) {
+	bootTimeOnce.Do(func() {
+		bootTime, bootTimeErr = readBootTime()
+	})
+	if bootTimeErr != nil {
+		return time.Time{}, bootTimeErr
+	}
+	return bootTime.Add(time.Duration(ticks) * time.Second / clockTicksPerSec), nil
+}
+
+func readBootTime() (time.Time, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "btime ") {
+			continue
+		}
+		secs, err := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(line, "btime ")), 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, os.ErrInvalid
+}
@@ -0,0 +1,126 @@
+package kprobes
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/elastic-agent-libs/mapstr"
+)
+
+func TestEcsAction(t *testing.T) {
+	tests := []struct {
+		op             uint32
+		wantAction     string
+		wantEventType0 string
+	}{
+		{unix.IN_CREATE, "file_create", "creation"},
+		{unix.IN_MODIFY, "file_modify", "change"},
+		{unix.IN_ATTRIB, "file_attrib", "change"},
+		{unix.IN_DELETE, "file_delete", "deletion"},
+		{unix.IN_MOVED_FROM, "file_rename_from", "change"},
+		{unix.IN_MOVED_TO, "file_rename_to", "change"},
+		{0, "file_unknown", "info"},
+	}
+
+	for _, tt := range tests {
+		action, eventType := ecsAction(tt.op)
+		assert.Equal(t, tt.wantAction, action)
+		require.Len(t, eventType, 1)
+		assert.Equal(t, tt.wantEventType0, eventType[0])
+	}
+}
+
+type capturingPublisher struct {
+	events []mapstr.M
+}
+
+func (p *capturingPublisher) Publish(event mapstr.M) {
+	p.events = append(p.events, event)
+}
+
+func TestECSEmitter_Emit_DegradesOnFullQueue(t *testing.T) {
+	pub := &capturingPublisher{}
+	// No workers draining and no queue capacity: every Emit must take the
+	// degraded path rather than block.
+	e := NewECSEmitter(pub, 0, 0, 0, time.Minute, nil)
+
+	require.NoError(t, e.Emit("/etc/passwd", 123, unix.IN_MODIFY))
+
+	require.Len(t, pub.events, 1)
+	assert.Equal(t, uint64(1), e.droppedEnrichment.Get())
+	assert.Equal(t, mapstr.M{"path": "/etc/passwd"}, pub.events[0]["file"])
+	assert.Equal(t, mapstr.M{"pid": uint32(123)}, pub.events[0]["process"])
+	assert.Equal(t, mapstr.M{"action": "file_modify"}, pub.events[0]["event"])
+}
+
+func TestECSEmitter_Enrich_PopulatesFileFields(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "watched.txt")
+	require.NoError(t, os.WriteFile(path, []byte("hello world"), 0o644))
+
+	e := &ECSEmitter{hashSizeCap: 1 << 20, procs: newProcCache(time.Minute)}
+	event := e.enrich(ecsJob{path: path, pid: uint32(os.Getpid()), op: unix.IN_CREATE})
+
+	fileFields, ok := event["file"].(mapstr.M)
+	require.True(t, ok)
+	assert.Equal(t, path, fileFields["path"])
+	assert.EqualValues(t, len("hello world"), fileFields["size"])
+
+	wantSum, err := sha256File(path)
+	require.NoError(t, err)
+	assert.Equal(t, mapstr.M{"sha256": wantSum}, fileFields["hash"])
+
+	eventFields, ok := event["event"].(mapstr.M)
+	require.True(t, ok)
+	assert.Equal(t, "file_create", eventFields["action"])
+
+	processFields, ok := event["process"].(mapstr.M)
+	require.True(t, ok)
+	assert.Equal(t, uint32(os.Getpid()), processFields["pid"])
+}
+
+func TestECSEmitter_Enrich_SkipsStatOnDelete(t *testing.T) {
+	e := &ECSEmitter{hashSizeCap: 1 << 20, procs: newProcCache(time.Minute)}
+	event := e.enrich(ecsJob{path: "/does/not/exist", pid: 1, op: unix.IN_DELETE})
+
+	fileFields, ok := event["file"].(mapstr.M)
+	require.True(t, ok)
+	assert.Equal(t, mapstr.M{"path": "/does/not/exist"}, fileFields)
+}
+
+func TestECSEmitter_Enrich_SkipsHashAboveSizeCap(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "big.txt")
+	require.NoError(t, os.WriteFile(path, []byte("0123456789"), 0o644))
+
+	e := &ECSEmitter{hashSizeCap: 1, procs: newProcCache(time.Minute)}
+	event := e.enrich(ecsJob{path: path, pid: uint32(os.Getpid()), op: unix.IN_MODIFY})
+
+	fileFields, ok := event["file"].(mapstr.M)
+	require.True(t, ok)
+	_, hasHash := fileFields["hash"]
+	assert.False(t, hasHash, "files over hashSizeCap should not be hashed")
+}
+
+func TestReadProcStartTime_CurrentProcess(t *testing.T) {
+	start, err := readProcStartTime("/proc/self")
+	require.NoError(t, err)
+	assert.False(t, start.IsZero())
+	assert.True(t, start.Before(time.Now()) || start.Equal(time.Now()))
+}
+
+func TestProcCache_CachesWithinTTL(t *testing.T) {
+	c := newProcCache(time.Hour)
+	pid := uint32(os.Getpid())
+
+	first := c.lookup(pid)
+	second := c.lookup(pid)
+
+	assert.Equal(t, first.cachedAt, second.cachedAt, "a lookup within the TTL should reuse the cached entry")
+}
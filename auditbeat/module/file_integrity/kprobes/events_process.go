@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"golang.org/x/sys/unix"
+	"os"
 	"path/filepath"
+	"sync"
 )
 
 // TODO(panosk) finalise the Emitter interface according to our needs
@@ -21,18 +23,55 @@ type eProcessor struct {
 	e           Emitter
 	d           *dEntryCache
 	isRecursive bool
+	// ignore, when set, suppresses events for paths matching a compiled set
+	// of gitignore-style patterns (see NewIgnoreMatcher). It is whatever the
+	// caller passed to newEventProcessor; nothing in this package reads it
+	// from the auditbeat FIM config. When it is nil, nothing is ignored.
+	ignore IgnoreMatcher
+
+	// processMu serializes process(), so reconciliation's synthesized
+	// events (called from the reconciler's own goroutine) can never run
+	// concurrently with the live kprobe reader's calls. Without it,
+	// e.p.WalkAsync, e.e.Emit and the per-TID moves map would be driven
+	// from two goroutines at once, and none of them were written to be
+	// safe against that.
+	processMu sync.Mutex
 }
 
-func newEventProcessor(p pathTraverser, e Emitter, isRecursive bool) *eProcessor {
+func newEventProcessor(p pathTraverser, e Emitter, isRecursive bool, ignore IgnoreMatcher, d *dEntryCache) *eProcessor {
 	return &eProcessor{
 		p:           p,
 		e:           e,
-		d:           newDirEntryCache(),
+		d:           d,
 		isRecursive: isRecursive,
+		ignore:      ignore,
 	}
 }
 
+// ignored reports whether path should be suppressed before it is cached or
+// emitted. path must be relative to the monitored root (dEntry.RelPath, not
+// Path) so anchored patterns line up the way they would against a gitignore
+// file at that root. isDir is best-effort: monitor events are known
+// directories and pass true; create and move-to stat the new path;
+// move-from and delete treat a cached entry with children as a directory
+// (so an empty directory counts as a file there); modify and attrib pass
+// false.
+func (e *eProcessor) ignored(path string, isDir bool) bool {
+	return e.ignore != nil && e.ignore.Match(path, isDir)
+}
+
+// isDirPath stats path to determine whether it is a directory. It is only
+// used on the create/move-to paths, where the kprobe event itself carries no
+// file-type information but the entry is known to still exist on disk.
+func isDirPath(path string) bool {
+	fi, err := os.Lstat(path)
+	return err == nil && fi.IsDir()
+}
+
 func (e *eProcessor) process(ctx context.Context, pe *ProbeEvent) error {
+	e.processMu.Lock()
+	defer e.processMu.Unlock()
+
 	// after processing return the probe event to the pool
 	defer releaseProbeEvent(pe)
 
@@ -58,6 +97,15 @@ func (e *eProcessor) process(ctx context.Context, pe *ProbeEvent) error {
 			DevMinor: pe.ParentDevMinor,
 		})
 
+		// A true monitored root (parentEntry == nil) has no path relative to
+		// itself to match patterns against - same as gitignore, the root of
+		// what's being watched can't exclude itself. Only a directory being
+		// (re)monitored below an already-monitored parent, e.g. after a
+		// move, has a meaningful relative path to check.
+		if parentEntry != nil && e.ignored(filepath.Join(parentEntry.RelPath(), pe.FileName), true) {
+			return nil
+		}
+
 		if parentEntry == nil {
 			entry = &dEntry{
 				Name:     monitorPath.fullPath,
@@ -97,6 +145,11 @@ func (e *eProcessor) process(ctx context.Context, pe *ProbeEvent) error {
 			return nil
 		}
 
+		createdPath := filepath.Join(parentEntry.Path(), pe.FileName)
+		if e.ignored(filepath.Join(parentEntry.RelPath(), pe.FileName), isDirPath(createdPath)) {
+			return nil
+		}
+
 		entry := &dEntry{
 			Children: nil,
 			Name:     pe.FileName,
@@ -120,6 +173,10 @@ func (e *eProcessor) process(ctx context.Context, pe *ProbeEvent) error {
 			return nil
 		}
 
+		if e.ignored(entry.RelPath(), false) {
+			return nil
+		}
+
 		return e.e.Emit(entry.Path(), pe.Meta.TID, unix.IN_MODIFY)
 
 	case pe.MaskAttrib == 1:
@@ -133,6 +190,10 @@ func (e *eProcessor) process(ctx context.Context, pe *ProbeEvent) error {
 			return nil
 		}
 
+		if e.ignored(entry.RelPath(), false) {
+			return nil
+		}
+
 		return e.e.Emit(entry.Path(), pe.Meta.TID, unix.IN_ATTRIB)
 
 	case pe.MaskMoveFrom == 1:
@@ -154,6 +215,11 @@ func (e *eProcessor) process(ctx context.Context, pe *ProbeEvent) error {
 
 		entryPath := entry.Path()
 
+		if e.ignored(entry.RelPath(), entry.Children != nil) {
+			e.d.MoveClear(uint64(pe.Meta.TID))
+			return nil
+		}
+
 		e.d.MoveFrom(uint64(pe.Meta.TID), entry)
 
 		return e.e.Emit(entryPath, pe.Meta.TID, unix.IN_MOVED_FROM)
@@ -172,6 +238,12 @@ func (e *eProcessor) process(ctx context.Context, pe *ProbeEvent) error {
 			return nil
 		}
 
+		newEntryPath := filepath.Join(parentEntry.Path(), pe.FileName)
+		if e.ignored(filepath.Join(parentEntry.RelPath(), pe.FileName), isDirPath(newEntryPath)) {
+			e.d.MoveClear(uint64(pe.Meta.TID))
+			return nil
+		}
+
 		moved, err := e.d.MoveTo(uint64(pe.Meta.TID), parentEntry, pe.FileName, func(path string) error {
 			return e.e.Emit(path, pe.Meta.TID, unix.IN_MOVED_TO)
 		})
@@ -182,7 +254,6 @@ func (e *eProcessor) process(ctx context.Context, pe *ProbeEvent) error {
 			return nil
 		}
 
-		newEntryPath := filepath.Join(parentEntry.Path(), pe.FileName)
 		e.p.WalkAsync(newEntryPath, parentEntry.Depth+1, pe.Meta.TID)
 
 		return nil
@@ -204,11 +275,14 @@ func (e *eProcessor) process(ctx context.Context, pe *ProbeEvent) error {
 		}
 
 		entryPath := entry.Path()
+		ignored := e.ignored(entry.RelPath(), entry.Children != nil)
 
 		e.d.Remove(entry)
 
-		if err := e.e.Emit(entryPath, pe.Meta.TID, unix.IN_DELETE); err != nil {
-			return err
+		if !ignored {
+			if err := e.e.Emit(entryPath, pe.Meta.TID, unix.IN_DELETE); err != nil {
+				return err
+			}
 		}
 
 		entry.Release()
@@ -0,0 +1,210 @@
+package kprobes
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// IgnoreMatcher decides whether a given path should be suppressed before it
+// reaches an Emitter. Implementations are expected to be safe for concurrent
+// use, since process may be invoked from multiple reader goroutines.
+type IgnoreMatcher interface {
+	Match(path string, isDir bool) bool
+}
+
+// igSegment is a single path-component of a compiled pattern, e.g. the
+// "*.log" in "build/*.log".
+type igSegment struct {
+	literal    string
+	isGlob     bool // contains '*', '?' or '[' and must go through filepath.Match
+	doubleStar bool // the whole segment was "**"
+}
+
+// igPattern is a single compiled line from a gitignore-style pattern source.
+type igPattern struct {
+	negate   bool
+	dirOnly  bool
+	anchored bool
+	segments []igSegment
+}
+
+// gitignoreMatcher evaluates paths against an ordered list of compiled
+// gitignore-style patterns. As with gitignore itself, patterns are evaluated
+// in order and the last matching pattern wins, so a later "!pattern" can
+// re-include something an earlier pattern excluded.
+type gitignoreMatcher struct {
+	patterns []igPattern
+}
+
+// NewIgnoreMatcher compiles inline patterns together with the contents of
+// patternFiles (read in order, each treated as an additional source of
+// lines) into an IgnoreMatcher. Both inline patterns and pattern files use
+// standard gitignore syntax.
+func NewIgnoreMatcher(inline []string, patternFiles []string) (IgnoreMatcher, error) {
+	m := &gitignoreMatcher{}
+
+	for _, file := range patternFiles {
+		lines, err := readPatternFile(file)
+		if err != nil {
+			return nil, err
+		}
+		m.addLines(lines)
+	}
+
+	m.addLines(inline)
+
+	return m, nil
+}
+
+func readPatternFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+func (m *gitignoreMatcher) addLines(lines []string) {
+	for _, line := range lines {
+		if p, ok := compilePattern(line); ok {
+			m.patterns = append(m.patterns, p)
+		}
+	}
+}
+
+// compilePattern compiles a single gitignore line. ok is false for blank
+// lines and comments, which carry no pattern.
+func compilePattern(line string) (igPattern, bool) {
+	// Trailing whitespace is stripped unless escaped, but we don't expect
+	// operators to rely on that edge case here; trim it outright.
+	line = strings.TrimRight(line, " \t")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return igPattern{}, false
+	}
+
+	var p igPattern
+
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	}
+
+	if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+
+	if strings.HasPrefix(line, "/") {
+		p.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+
+	// A pattern containing a slash anywhere (other than a trailing one,
+	// already stripped above) is anchored to the root it's declared
+	// relative to, same as gitignore.
+	if strings.Contains(line, "/") {
+		p.anchored = true
+	}
+
+	for _, seg := range strings.Split(line, "/") {
+		switch seg {
+		case "**":
+			p.segments = append(p.segments, igSegment{doubleStar: true})
+		default:
+			p.segments = append(p.segments, igSegment{
+				literal: seg,
+				isGlob:  strings.ContainsAny(seg, "*?["),
+			})
+		}
+	}
+
+	return p, true
+}
+
+// Match reports whether path (slash-separated, relative to the monitored
+// root) is ignored. The last pattern that matches determines the outcome,
+// so a negated pattern can re-include a path an earlier pattern excluded.
+func (m *gitignoreMatcher) Match(path string, isDir bool) bool {
+	path = filepath.ToSlash(path)
+	path = strings.TrimPrefix(path, "/")
+	segments := strings.Split(path, "/")
+
+	ignored := false
+	for _, p := range m.patterns {
+		pathSegments := segments
+		if p.dirOnly && !isDir {
+			// A file can't match a dir-only pattern itself, but it is still
+			// covered by one that matches any of its ancestor directories.
+			pathSegments = segments[:len(segments)-1]
+		}
+		if len(pathSegments) > 0 && matchPattern(p, pathSegments) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+// matchPattern tries to match the full pattern against every anchor point in
+// segments: index 0 only if the pattern is anchored, every index otherwise
+// (gitignore patterns without a slash match at any depth).
+func matchPattern(p igPattern, segments []string) bool {
+	if p.anchored {
+		return matchSegments(p.segments, segments)
+	}
+	for start := range segments {
+		if matchSegments(p.segments, segments[start:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments walks pattern segments against path segments, expanding "**"
+// to zero or more path segments. Once the pattern is fully consumed the
+// match succeeds even if path segments remain: as in gitignore, a pattern
+// that matches a directory also matches everything beneath it.
+func matchSegments(pattern []igSegment, path []string) bool {
+	if len(pattern) == 0 {
+		return true
+	}
+
+	head := pattern[0]
+
+	if head.doubleStar {
+		// "**" may consume zero or more path segments; try every split.
+		for consumed := 0; consumed <= len(path); consumed++ {
+			if matchSegments(pattern[1:], path[consumed:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(path) == 0 {
+		return false
+	}
+
+	if head.isGlob {
+		ok, err := filepath.Match(head.literal, path[0])
+		if err != nil || !ok {
+			return false
+		}
+	} else if head.literal != path[0] {
+		return false
+	}
+
+	return matchSegments(pattern[1:], path[1:])
+}
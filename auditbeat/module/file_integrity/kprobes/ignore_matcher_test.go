@@ -0,0 +1,97 @@
+package kprobes
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitignoreMatcher_Match(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		{
+			name:     "anchored pattern only matches at the root",
+			patterns: []string{"/node_modules"},
+			path:     "node_modules",
+			isDir:    true,
+			want:     true,
+		},
+		{
+			name:     "anchored pattern does not match deeper occurrences",
+			patterns: []string{"/node_modules"},
+			path:     "src/node_modules",
+			isDir:    true,
+			want:     false,
+		},
+		{
+			name:     "unanchored pattern matches at any depth",
+			patterns: []string{"*.log"},
+			path:     "build/debug/run.log",
+			isDir:    false,
+			want:     true,
+		},
+		{
+			name:     "dir-only pattern does not match a plain file",
+			patterns: []string{"build/"},
+			path:     "build",
+			isDir:    false,
+			want:     false,
+		},
+		{
+			name:     "dir-only pattern matches a directory",
+			patterns: []string{"build/"},
+			path:     "build",
+			isDir:    true,
+			want:     true,
+		},
+		{
+			name:     "matching a directory also matches everything beneath it",
+			patterns: []string{"/vendor"},
+			path:     "vendor/pkg/file.go",
+			isDir:    false,
+			want:     true,
+		},
+		{
+			name:     "double star matches across any number of intermediate segments",
+			patterns: []string{"**/vendor/**"},
+			path:     "a/b/vendor/c/d.go",
+			isDir:    false,
+			want:     true,
+		},
+		{
+			name:     "later negation re-includes a path excluded earlier",
+			patterns: []string{"*.log", "!important.log"},
+			path:     "important.log",
+			isDir:    false,
+			want:     false,
+		},
+		{
+			name:     "negation only re-includes what it names",
+			patterns: []string{"*.log", "!important.log"},
+			path:     "debug.log",
+			isDir:    false,
+			want:     true,
+		},
+		{
+			name:     "comments and blank lines carry no pattern",
+			patterns: []string{"# a comment", "", "*.tmp"},
+			path:     "a.tmp",
+			isDir:    false,
+			want:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewIgnoreMatcher(tt.patterns, nil)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, m.Match(tt.path, tt.isDir))
+		})
+	}
+}
@@ -0,0 +1,341 @@
+package kprobes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/elastic/beats/v7/libbeat/logp"
+)
+
+// merkleHash is the content hash of a single dEntry: H(mode||size||mtime||ino)
+// for a leaf, or H(sorted(childName||childHash)) for a directory.
+type merkleHash [32]byte
+
+// Reconcile walks root on disk, hashes it into a merkle trie and diffs that
+// trie against the cached dEntry tree for root, synthesizing whatever
+// IN_CREATE/IN_DELETE/IN_MODIFY/IN_ATTRIB events were missed because the
+// kprobe ring buffer dropped the events that would normally have kept the
+// cache in sync.
+//
+// It is safe to call concurrently with live event processing: every read of
+// cached dEntry state goes through dEntryCache's locked accessors (never a
+// direct field read), and synthesized events are funneled through the same
+// process() method real kprobe events go through. process() itself holds
+// eProcessor.processMu for its duration, so a reconciliation pass and the
+// live reader can never be inside it at the same time - WalkAsync, Emit and
+// the per-TID moves map only ever see one caller at a time.
+func (e *eProcessor) Reconcile(ctx context.Context, root string) error {
+	rootKey, fi, err := statKey(root)
+	if err != nil {
+		return err
+	}
+
+	cached := e.d.Get(rootKey)
+	if cached == nil {
+		// Nothing cached for this root yet; a normal walk will populate it,
+		// reconciliation has nothing to compare against.
+		return nil
+	}
+
+	_, err = e.reconcileDir(ctx, root, fi, cached)
+	return err
+}
+
+// reconcileDir diffs the directory at path against cached (never nil),
+// returning the freshly computed hash for path so the caller can fold it
+// into its own parent hash.
+func (e *eProcessor) reconcileDir(ctx context.Context, path string, fi os.FileInfo, cached *dEntry) (merkleHash, error) {
+	if err := ctx.Err(); err != nil {
+		return merkleHash{}, err
+	}
+
+	cachedHash, cachedMtime, cachedChildren := e.d.DirSnapshot(cached)
+
+	// Key performance win: if nothing has been added, removed or renamed
+	// directly under this directory since we last confirmed it (its own
+	// mtime hasn't moved) and we've already hashed it once, trust the
+	// subtree and skip walking it entirely. This only short-circuits
+	// structural changes at this level - an in-place edit of an existing
+	// file's content several levels down still bumps that file's own mtime
+	// and is caught whenever this fast path doesn't apply to one of its
+	// ancestors, or by the live kprobe MODIFY event in the meantime.
+	if cachedHash != (merkleHash{}) && cachedMtime == fi.ModTime().UnixNano() {
+		return cachedHash, nil
+	}
+
+	dirEntries, err := os.ReadDir(path)
+	if err != nil {
+		return merkleHash{}, err
+	}
+
+	childHashes := make(map[string]merkleHash, len(dirEntries))
+	seen := make(map[string]bool, len(dirEntries))
+
+	for _, de := range dirEntries {
+		name := de.Name()
+		seen[name] = true
+		childPath := filepath.Join(path, name)
+
+		childFi, err := os.Lstat(childPath)
+		if err != nil {
+			// Raced with a concurrent delete; the next reconciliation (or
+			// the live event stream) will settle it.
+			continue
+		}
+
+		var childEntry *dEntry
+		if key, ok := cachedChildren[name]; ok {
+			childEntry = e.d.Get(key)
+		}
+
+		if childEntry == nil {
+			// Unknown to the cache: synthesize its CREATE (and, for a
+			// directory, do so *before* descending) so the parent link
+			// exists by the time any grandchild CREATE looks it up.
+			created, err := e.synthesizeCreate(ctx, cached, name, childFi)
+			if err != nil {
+				return merkleHash{}, err
+			}
+			childEntry = created
+		}
+
+		if childFi.IsDir() {
+			if childEntry == nil {
+				// Not tracked (e.g. excluded by an ignore pattern, or
+				// beyond the non-recursive depth limit): leave it out of
+				// the hash entirely, same as the live event path would.
+				continue
+			}
+			hash, err := e.reconcileDir(ctx, childPath, childFi, childEntry)
+			if err != nil {
+				return merkleHash{}, err
+			}
+			childHashes[name] = hash
+			continue
+		}
+
+		hash := leafHash(childFi)
+		childHashes[name] = hash
+
+		if childEntry == nil {
+			continue
+		}
+		leafHashCached, _, _ := e.d.DirSnapshot(childEntry)
+		switch {
+		case leafHashCached == (merkleHash{}):
+			// Never reconciled before (including a leaf just created above
+			// by synthesizeCreate): record its hash so the next pass has
+			// something to compare against, without synthesizing a MODIFY
+			// for a file nothing has actually changed.
+			e.d.RefreshLeaf(childEntry, uint32(childFi.Mode()), childFi.Size(), childFi.ModTime().UnixNano(), hash)
+		case leafHashCached != hash:
+			if err := e.synthesizeUpdate(ctx, childEntry, childFi, hash); err != nil {
+				return merkleHash{}, err
+			}
+		}
+	}
+
+	// Anything cached under this directory that the filesystem no longer
+	// has was deleted without our noticing.
+	for name := range cachedChildren {
+		if seen[name] {
+			continue
+		}
+		if err := e.synthesizeDelete(ctx, cached, name); err != nil {
+			return merkleHash{}, err
+		}
+	}
+
+	dirHash := hashChildren(childHashes)
+	e.d.RefreshDir(cached, uint32(fi.Mode()), fi.ModTime().UnixNano(), dirHash)
+
+	return dirHash, nil
+}
+
+// synthesizeCreate injects a CREATE event for a path found on disk but
+// missing from the cache, through the normal process() path, and returns
+// the resulting cache entry (nil if process() chose not to track it, e.g.
+// because it's excluded by an ignore pattern).
+func (e *eProcessor) synthesizeCreate(ctx context.Context, parent *dEntry, name string, fi os.FileInfo) (*dEntry, error) {
+	key, _, err := statKey(filepath.Join(parent.Path(), name))
+	if err != nil {
+		return nil, err
+	}
+
+	pe := &ProbeEvent{
+		MaskCreate:     1,
+		FileName:       name,
+		FileIno:        key.Ino,
+		FileDevMajor:   key.DevMajor,
+		FileDevMinor:   key.DevMinor,
+		ParentIno:      parent.Ino,
+		ParentDevMajor: parent.DevMajor,
+		ParentDevMinor: parent.DevMinor,
+	}
+
+	if err := e.process(ctx, pe); err != nil {
+		return nil, err
+	}
+
+	return e.d.Get(key), nil
+}
+
+// synthesizeUpdate injects a MODIFY (or ATTRIB, when only metadata but not
+// size/mtime changed) event for an entry whose on-disk leaf hash no longer
+// matches what's cached.
+func (e *eProcessor) synthesizeUpdate(ctx context.Context, cached *dEntry, fi os.FileInfo, hash merkleHash) error {
+	contentChanged := e.d.RefreshLeaf(cached, uint32(fi.Mode()), fi.Size(), fi.ModTime().UnixNano(), hash)
+
+	pe := &ProbeEvent{
+		FileName:     cached.Name,
+		FileIno:      cached.Ino,
+		FileDevMajor: cached.DevMajor,
+		FileDevMinor: cached.DevMinor,
+	}
+	if contentChanged {
+		pe.MaskModify = 1
+	} else {
+		pe.MaskAttrib = 1
+	}
+
+	return e.process(ctx, pe)
+}
+
+// synthesizeDelete injects a DELETE event for a cache entry, identified by
+// parent and name, that no longer exists on disk.
+func (e *eProcessor) synthesizeDelete(ctx context.Context, parent *dEntry, name string) error {
+	pe := &ProbeEvent{
+		MaskDelete:     1,
+		FileName:       name,
+		ParentIno:      parent.Ino,
+		ParentDevMajor: parent.DevMajor,
+		ParentDevMinor: parent.DevMinor,
+	}
+
+	return e.process(ctx, pe)
+}
+
+// statKey stats path and returns both the dKey the cache keys entries by
+// and the raw FileInfo, so callers needing the mode/size/mtime don't have
+// to stat twice.
+func statKey(path string) (dKey, os.FileInfo, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return dKey{}, nil, err
+	}
+	st, ok := fi.Sys().(*unix.Stat_t)
+	if !ok {
+		return dKey{}, nil, os.ErrInvalid
+	}
+	return dKey{
+		Ino:      st.Ino,
+		DevMajor: unix.Major(uint64(st.Dev)),
+		DevMinor: unix.Minor(uint64(st.Dev)),
+	}, fi, nil
+}
+
+// leafHash hashes the (mode, size, mtime, ino) tuple describing fi.
+func leafHash(fi os.FileInfo) merkleHash {
+	st, _ := fi.Sys().(*unix.Stat_t)
+	var ino uint64
+	if st != nil {
+		ino = st.Ino
+	}
+
+	var buf [28]byte
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(fi.Mode()))
+	binary.LittleEndian.PutUint64(buf[4:12], uint64(fi.Size()))
+	binary.LittleEndian.PutUint64(buf[12:20], uint64(fi.ModTime().UnixNano()))
+	binary.LittleEndian.PutUint64(buf[20:28], ino)
+
+	return sha256.Sum256(buf[:])
+}
+
+// hashChildren hashes a directory's sorted (name, childHash) pairs. Sorting
+// by name keeps the hash stable regardless of readdir order.
+func hashChildren(children map[string]merkleHash) merkleHash {
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		h.Write([]byte(name))
+		childHash := children[name]
+		h.Write(childHash[:])
+	}
+
+	var out merkleHash
+	copy(out[:], h.Sum(nil))
+	return out
+}
+
+// reconciler periodically reconciles every monitored root against the
+// on-disk state, and can additionally be kicked off-schedule by the kprobe
+// reader when it detects a ring-buffer overflow (i.e. events were almost
+// certainly dropped).
+type reconciler struct {
+	e        *eProcessor
+	interval time.Duration
+	roots    func() []string
+	overflow chan struct{}
+
+	log *logp.Logger
+}
+
+// newReconciler builds a reconciler that reconciles every root returned by
+// roots() every interval, plus immediately whenever TriggerNow is called.
+func newReconciler(e *eProcessor, interval time.Duration, roots func() []string) *reconciler {
+	return &reconciler{
+		e:        e,
+		interval: interval,
+		roots:    roots,
+		overflow: make(chan struct{}, 1),
+		log:      logp.NewLogger("kprobes"),
+	}
+}
+
+// TriggerNow schedules an out-of-band reconciliation pass, coalescing with
+// any pass already pending. Intended to be called from the probe-loss path
+// when a ring-buffer overflow is detected.
+func (r *reconciler) TriggerNow() {
+	select {
+	case r.overflow <- struct{}{}:
+	default:
+		// a pass is already pending, no need to queue another
+	}
+}
+
+// Run blocks reconciling on a timer (and on TriggerNow) until ctx is done.
+func (r *reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.reconcileAll(ctx)
+		case <-r.overflow:
+			r.reconcileAll(ctx)
+		}
+	}
+}
+
+func (r *reconciler) reconcileAll(ctx context.Context) {
+	for _, root := range r.roots() {
+		if err := r.e.Reconcile(ctx, root); err != nil {
+			r.log.Errorw("reconciliation failed", "root", root, "error", err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package kprobes
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// fakeEmitter records every event handed to it, in order, so tests can
+// assert on what reconcileDir synthesized without a real ECSEmitter.
+type fakeEmitter struct {
+	events []fakeEmitterEvent
+}
+
+type fakeEmitterEvent struct {
+	path string
+	op   uint32
+}
+
+func (f *fakeEmitter) Emit(path string, pid uint32, op uint32) error {
+	f.events = append(f.events, fakeEmitterEvent{path: path, op: op})
+	return nil
+}
+
+func (f *fakeEmitter) has(path string, op uint32) bool {
+	for _, ev := range f.events {
+		if ev.path == path && ev.op == op {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLeafHash_ChangesWithContent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "f.txt")
+	require.NoError(t, os.WriteFile(path, []byte("v1"), 0o644))
+
+	fi1, err := os.Lstat(path)
+	require.NoError(t, err)
+	h1 := leafHash(fi1)
+
+	require.NoError(t, os.WriteFile(path, []byte("v2, a bit longer"), 0o644))
+	fi2, err := os.Lstat(path)
+	require.NoError(t, err)
+	h2 := leafHash(fi2)
+
+	assert.NotEqual(t, h1, h2, "a content/size change must change the leaf hash")
+}
+
+func TestLeafHash_StableForUnchangedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "f.txt")
+	require.NoError(t, os.WriteFile(path, []byte("stable"), 0o644))
+
+	fi, err := os.Lstat(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, leafHash(fi), leafHash(fi))
+}
+
+func TestHashChildren_OrderIndependent(t *testing.T) {
+	children := map[string]merkleHash{
+		"a": {1},
+		"b": {2},
+		"c": {3},
+	}
+	reordered := map[string]merkleHash{
+		"c": {3},
+		"a": {1},
+		"b": {2},
+	}
+
+	assert.Equal(t, hashChildren(children), hashChildren(reordered))
+}
+
+func TestHashChildren_ChangesWithMembership(t *testing.T) {
+	base := hashChildren(map[string]merkleHash{"a": {1}, "b": {2}})
+	withExtra := hashChildren(map[string]merkleHash{"a": {1}, "b": {2}, "c": {3}})
+	renamed := hashChildren(map[string]merkleHash{"a": {1}, "z": {2}})
+
+	assert.NotEqual(t, base, withExtra, "adding a child must change the directory hash")
+	assert.NotEqual(t, base, renamed, "renaming a child must change the directory hash")
+}
+
+func TestStatKey_IdentifiesDistinctFiles(t *testing.T) {
+	dir := t.TempDir()
+	p1 := filepath.Join(dir, "a")
+	p2 := filepath.Join(dir, "b")
+	require.NoError(t, os.WriteFile(p1, nil, 0o644))
+	require.NoError(t, os.WriteFile(p2, nil, 0o644))
+
+	k1, _, err := statKey(p1)
+	require.NoError(t, err)
+	k2, _, err := statKey(p2)
+	require.NoError(t, err)
+
+	assert.NotEqual(t, k1, k2)
+	assert.False(t, k1.zero())
+}
+
+func TestReconcileDir_SynthesizesCreateUpdateAndDelete(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "existing.txt"), []byte("v1"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "deleteme.txt"), []byte("v1"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "nested.txt"), []byte("v1"), 0o644))
+
+	cache, err := newDirEntryCache(1024, "", nil)
+	require.NoError(t, err)
+
+	emitter := &fakeEmitter{}
+	e := &eProcessor{e: emitter, d: cache, isRecursive: true}
+
+	rootKey, rootFi, err := statKey(dir)
+	require.NoError(t, err)
+	root := &dEntry{Name: dir, Ino: rootKey.Ino, DevMajor: rootKey.DevMajor, DevMinor: rootKey.DevMinor}
+	cache.Add(root, nil)
+
+	_, err = e.reconcileDir(context.Background(), dir, rootFi, root)
+	require.NoError(t, err)
+
+	assert.True(t, emitter.has(filepath.Join(dir, "existing.txt"), unix.IN_CREATE))
+	assert.True(t, emitter.has(filepath.Join(dir, "deleteme.txt"), unix.IN_CREATE))
+	assert.True(t, emitter.has(filepath.Join(dir, "sub"), unix.IN_CREATE))
+	assert.True(t, emitter.has(filepath.Join(dir, "sub", "nested.txt"), unix.IN_CREATE),
+		"a newly discovered subdirectory's own children must be synthesized too, not just the subdirectory itself")
+
+	emitter.events = nil
+
+	// Modify one file and delete another directly under root, so root's own
+	// mtime moves and the fast path in reconcileDir doesn't short-circuit
+	// the second pass; leave sub/ untouched so it's the one exercising the
+	// fast path this time.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "existing.txt"), []byte("v2, now longer"), 0o644))
+	require.NoError(t, os.Remove(filepath.Join(dir, "deleteme.txt")))
+
+	root = cache.Get(rootKey)
+	require.NotNil(t, root)
+	rootFi, err = os.Lstat(dir)
+	require.NoError(t, err)
+
+	_, err = e.reconcileDir(context.Background(), dir, rootFi, root)
+	require.NoError(t, err)
+
+	assert.True(t, emitter.has(filepath.Join(dir, "existing.txt"), unix.IN_MODIFY))
+	assert.True(t, emitter.has(filepath.Join(dir, "deleteme.txt"), unix.IN_DELETE))
+	assert.False(t, emitter.has(filepath.Join(dir, "sub"), unix.IN_CREATE), "sub was already cached and unchanged, it must not be re-synthesized")
+}